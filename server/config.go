@@ -20,15 +20,26 @@ import (
 	"github.com/logrange/range/pkg/transport"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/jrivets/log4g"
 	"github.com/logrange/range/pkg/cluster"
 	"github.com/logrange/range/pkg/cluster/model"
 	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
 )
 
+// envVarPrefix is prepended to the upper-cased, underscore-separated field
+// path when looking up an environment variable override for a Config field,
+// e.g. JournalsDir becomes LOGRANGE_JOURNALS_DIR.
+const envVarPrefix = "LOGRANGE_"
+
 // Config struct defines logragnge server settings
 type Config struct {
 	// JournalsDir - contains path ont the local file-system where journals
@@ -53,6 +64,12 @@ type Config struct {
 
 	// PrivateApiRpc represents the transport configuration for private RPC API
 	PrivateApiRpc transport.Config
+
+	// set records which of the fields above were explicitly provided by
+	// whatever produced this Config (a file, the environment, CLI flags),
+	// as opposed to left at their Go zero value. See fieldSet and
+	// ResolveConfig.
+	set fieldSet
 }
 
 var configLog = log4g.GetLogger("Config")
@@ -74,6 +91,7 @@ func GetDefaultConfig() *Config {
 	c.PublicApiRpc.ListenAddr = "127.0.0.1:9966"
 	c.PrivateApiRpc.ListenAddr = "127.0.0.1:9967"
 	c.HostLeaseTTLSec = 5
+	c.set = fsJournalsDir | fsPublicApiRpcListenAddr | fsPrivateApiRpcListenAddr | fsHostLeaseTTLSec | fsHostRegisterTimeoutSec
 	return c
 }
 
@@ -98,6 +116,11 @@ func (c *Config) RegisterTimeout() time.Duration {
 }
 
 // Apply override c's properties by non-default values from cfg
+//
+// Deprecated: Apply treats a zero value as "unset", so there is no way to
+// legitimately apply e.g. HostLeaseTTLSec=0. Use ResolveConfig, which tracks
+// explicitly-provided fields via fieldSet instead of guessing from zero
+// values.
 func (c *Config) Apply(cfg *Config) {
 	if cfg == nil {
 		return
@@ -151,3 +174,200 @@ func ReadConfigFromFile(filename string) *Config {
 	configLog.Info("Configuration read from ", filename)
 	return c
 }
+
+// ConfigError reports a problem found while loading the configuration from
+// a file or the environment - a malformed file, an unsupported format or an
+// environment variable that could not be parsed into its field type.
+type ConfigError struct {
+	// Source identifies what was being parsed - a file name or an
+	// environment variable name
+	Source string
+	Cause  error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("config: could not load %s: %v", e.Source, e.Cause)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Cause
+}
+
+// LoadConfig reads the configuration from filename, auto-detecting the
+// format (JSON, YAML or TOML) by its extension, then overlays any
+// LOGRANGE_<FIELD> environment variables on top of the parsed values. An
+// empty filename is allowed and yields the zero Config with env overrides
+// applied on top of it. Unlike ReadConfigFromFile, LoadConfig never panics -
+// every error is returned as a *ConfigError.
+func LoadConfig(filename string) (*Config, error) {
+	c := &Config{}
+
+	if filename != "" {
+		cfgData, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, &ConfigError{Source: filename, Cause: err}
+		}
+
+		if err := unmarshalConfig(filename, cfgData, c); err != nil {
+			return nil, err
+		}
+
+		configLog.Info("Configuration read from ", filename)
+	}
+
+	if err := applyEnvOverrides(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// unmarshalConfig picks the decoder by the filename extension, unmarshals
+// cfgData into c and marks, in c's fieldSet, every leaf field the file
+// actually contained.
+func unmarshalConfig(filename string, cfgData []byte, c *Config) error {
+	raw := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json", "":
+		if err := json.Unmarshal(cfgData, c); err != nil {
+			return &ConfigError{Source: filename, Cause: err}
+		}
+		json.Unmarshal(cfgData, &raw)
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(cfgData, c); err != nil {
+			return &ConfigError{Source: filename, Cause: err}
+		}
+		yaml.Unmarshal(cfgData, &raw)
+	case ".toml":
+		if err := toml.Unmarshal(cfgData, c); err != nil {
+			return &ConfigError{Source: filename, Cause: err}
+		}
+		toml.Unmarshal(cfgData, &raw)
+	default:
+		return &ConfigError{Source: filename, Cause: fmt.Errorf("unsupported config file extension %q, expected .json, .yaml/.yml or .toml", ext)}
+	}
+
+	markPresentFields("", raw, c)
+	return nil
+}
+
+// markPresentFields walks raw, the generic decode of a config file,
+// matching its keys against fieldBits by dotted path (see fieldBits) and
+// marking every one found in c's fieldSet. It recurses into nested objects
+// so that e.g. {"publicApiRpc": {"listenAddr": "..."}} marks exactly
+// fsPublicApiRpcListenAddr, not a bit for the whole PublicApiRpc struct.
+func markPresentFields(prefix string, raw map[string]interface{}, c *Config) {
+	for k, v := range raw {
+		path := strings.ToLower(k)
+		if prefix != "" {
+			path = prefix + "." + path
+		}
+
+		if bit, ok := fieldBits[path]; ok {
+			c.set |= bit
+			continue
+		}
+
+		switch nested := v.(type) {
+		case map[string]interface{}:
+			markPresentFields(path, nested, c)
+		case map[interface{}]interface{}:
+			// yaml.v2 decodes nested mappings with interface{} keys
+			m := make(map[string]interface{}, len(nested))
+			for nk, nv := range nested {
+				m[fmt.Sprint(nk)] = nv
+			}
+			markPresentFields(path, m, c)
+		}
+	}
+}
+
+var (
+	envNameFirstCap = regexp.MustCompile("(.)([A-Z][a-z]+)")
+	envNameAllCap   = regexp.MustCompile("([a-z0-9])([A-Z])")
+)
+
+// envFieldName turns a Go field name like HostLeaseTTLSec into the
+// underscore-separated, upper-cased form used in its LOGRANGE_ env var
+// name, e.g. HOST_LEASE_TTL_SEC.
+func envFieldName(name string) string {
+	name = envNameFirstCap.ReplaceAllString(name, "${1}_${2}")
+	name = envNameAllCap.ReplaceAllString(name, "${1}_${2}")
+	return strings.ToUpper(name)
+}
+
+// applyEnvOverrides walks c with reflection and overlays any LOGRANGE_<FIELD>
+// environment variable found for a field or, for nested structs like
+// PublicApiRpc, LOGRANGE_<STRUCT>_<FIELD>. Every field touched this way is
+// also marked in c's fieldSet.
+func applyEnvOverrides(c *Config) error {
+	return applyEnvOverridesTo(envVarPrefix, reflect.ValueOf(c).Elem(), c, "")
+}
+
+// applyEnvOverridesTo recurses into v, which is either c itself (path=="")
+// or one of its nested struct fields, in which case path is the dotted,
+// lower-cased field path leading to v (e.g. "publicapirpc"), used to look
+// up the fieldSet bit of whatever leaf field is actually overridden.
+func applyEnvOverridesTo(prefix string, v reflect.Value, c *Config, path string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			// unexported field, e.g. Config.set - not overridable
+			continue
+		}
+
+		f := v.Field(i)
+		envName := prefix + envFieldName(sf.Name)
+		fieldPath := strings.ToLower(sf.Name)
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		if f.Kind() == reflect.Struct {
+			if err := applyEnvOverridesTo(envName+"_", f, c, fieldPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		val, ok := os.LookupEnv(envName)
+		if !ok {
+			continue
+		}
+
+		if err := setFieldFromEnv(f, envName, val); err != nil {
+			return err
+		}
+		c.set |= fieldBit(fieldPath)
+	}
+	return nil
+}
+
+func setFieldFromEnv(f reflect.Value, envName, val string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, f.Type().Bits())
+		if err != nil {
+			return &ConfigError{Source: envName, Cause: err}
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, f.Type().Bits())
+		if err != nil {
+			return &ConfigError{Source: envName, Cause: err}
+		}
+		f.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return &ConfigError{Source: envName, Cause: err}
+		}
+		f.SetBool(b)
+	default:
+		return &ConfigError{Source: envName, Cause: fmt.Errorf("unsupported field type %s for env override", f.Kind())}
+	}
+	return nil
+}
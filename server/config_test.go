@@ -0,0 +1,120 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/logrange/range/pkg/cluster"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		checkConfig func(t *testing.T, c *Config)
+		wantSet     fieldSet
+	}{
+		{
+			name: "scalar field",
+			env:  map[string]string{"LOGRANGE_JOURNALS_DIR": "/tmp/journals"},
+			checkConfig: func(t *testing.T, c *Config) {
+				if c.JournalsDir != "/tmp/journals" {
+					t.Errorf("JournalsDir = %q, want /tmp/journals", c.JournalsDir)
+				}
+			},
+			wantSet: fsJournalsDir,
+		},
+		{
+			name: "explicit zero value is tracked, not ignored",
+			env:  map[string]string{"LOGRANGE_HOST_LEASE_TTL_SEC": "0"},
+			checkConfig: func(t *testing.T, c *Config) {
+				if c.HostLeaseTTLSec != 0 {
+					t.Errorf("HostLeaseTTLSec = %d, want 0", c.HostLeaseTTLSec)
+				}
+			},
+			wantSet: fsHostLeaseTTLSec,
+		},
+		{
+			name: "nested transport field",
+			env:  map[string]string{"LOGRANGE_PUBLIC_API_RPC_LISTEN_ADDR": "127.0.0.1:1234"},
+			checkConfig: func(t *testing.T, c *Config) {
+				if c.PublicApiRpc.ListenAddr != "127.0.0.1:1234" {
+					t.Errorf("PublicApiRpc.ListenAddr = %q, want 127.0.0.1:1234", c.PublicApiRpc.ListenAddr)
+				}
+			},
+			wantSet: fsPublicApiRpcListenAddr,
+		},
+		{
+			name: "HostHostId",
+			env:  map[string]string{"LOGRANGE_HOST_HOST_ID": "42"},
+			checkConfig: func(t *testing.T, c *Config) {
+				if c.HostHostId != cluster.HostId(42) {
+					t.Errorf("HostHostId = %v, want 42", c.HostHostId)
+				}
+			},
+			wantSet: fsHostHostId,
+		},
+		{
+			name:        "no env vars set, nothing marked",
+			env:         map[string]string{},
+			checkConfig: func(t *testing.T, c *Config) {},
+			wantSet:     0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			c := &Config{}
+			if err := applyEnvOverrides(c); err != nil {
+				t.Fatalf("applyEnvOverrides() error = %v", err)
+			}
+
+			tt.checkConfig(t, c)
+
+			if c.set != tt.wantSet {
+				t.Errorf("fieldSet = %b, want %b", c.set, tt.wantSet)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverridesInvalidValue(t *testing.T) {
+	os.Setenv("LOGRANGE_HOST_LEASE_TTL_SEC", "not-a-number")
+	defer os.Unsetenv("LOGRANGE_HOST_LEASE_TTL_SEC")
+
+	c := &Config{}
+	if err := applyEnvOverrides(c); err == nil {
+		t.Fatal("applyEnvOverrides() expected an error for a non-numeric HostLeaseTTLSec, got nil")
+	}
+}
+
+func TestApplyEnvOverridesRejectsOverflow(t *testing.T) {
+	// cluster.HostId is a uint16; a value one past its range must be
+	// rejected, not silently truncated back into the "unset" zero value.
+	os.Setenv("LOGRANGE_HOST_HOST_ID", "65536")
+	defer os.Unsetenv("LOGRANGE_HOST_HOST_ID")
+
+	c := &Config{}
+	if err := applyEnvOverrides(c); err == nil {
+		t.Fatalf("applyEnvOverrides() expected an overflow error for HostHostId=65536, got nil and HostHostId=%v", c.HostHostId)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/logrange/range/pkg/cluster"
+	"github.com/pkg/errors"
+)
+
+// hostStateFileName is the name of the state file written under
+// Config.JournalsDir to persist the host identity between restarts.
+const hostStateFileName = ".host_state.json"
+
+// HostState is the on-disk record of the host identity. It is written
+// under JournalsDir so that a node restarting with the same data directory
+// keeps registering itself in the cluster store under the same HostId,
+// instead of being assigned a new one and leaving a stale registration
+// behind.
+type HostState struct {
+	// HostId is the identifier this host registers itself with
+	HostId cluster.HostId
+
+	// Generation is incremented every time the state file is saved. It is
+	// informational only - it lets an operator tell, from the file alone,
+	// how many times the host has been (re)started with this data dir.
+	Generation int
+}
+
+// Validate checks hs against an explicitly configured HostHostId, if any.
+// A mismatch means the data directory was copied or reused under a
+// different configured identity, and continuing would duplicate that
+// host's registration in the cluster store under two HostIds - so it
+// fails fast instead.
+func (hs *HostState) Validate(configuredHostId cluster.HostId) error {
+	if configuredHostId > 0 && hs.HostId != configuredHostId {
+		return errors.Errorf("HostState.HostId=%v on disk does not match configured HostHostId=%v; "+
+			"refusing to start to avoid duplicating this host's registration under two ids", hs.HostId, configuredHostId)
+	}
+	return nil
+}
+
+// LoadOrCreateHostState reads the HostState persisted under c.JournalsDir,
+// creating one on first run. If c.HostHostId is not set, a new id is
+// generated and persisted; otherwise the on-disk HostId is validated
+// against it. Either way, c.HostHostId is updated to the resolved id, so
+// c.HostId() reflects it for the cluster registration path.
+func (c *Config) LoadOrCreateHostState() (*HostState, error) {
+	fn := filepath.Join(c.JournalsDir, hostStateFileName)
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "could not read host state file %s", fn)
+		}
+
+		hostId := c.HostHostId
+		if hostId == 0 {
+			hostId, err = newHostId()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		hs := &HostState{HostId: hostId, Generation: 1}
+		if err := hs.save(fn); err != nil {
+			return nil, err
+		}
+		c.HostHostId = hs.HostId
+		return hs, nil
+	}
+
+	hs := &HostState{}
+	if err := json.Unmarshal(data, hs); err != nil {
+		return nil, errors.Wrapf(err, "could not unmarshal host state file %s", fn)
+	}
+
+	if err := hs.Validate(c.HostHostId); err != nil {
+		return nil, err
+	}
+
+	hs.Generation++
+	if err := hs.save(fn); err != nil {
+		return nil, err
+	}
+
+	c.HostHostId = hs.HostId
+	return hs, nil
+}
+
+// newHostId generates a random, non-zero HostId for a host that has no
+// explicitly configured HostHostId and no prior persisted HostState.
+func newHostId() (cluster.HostId, error) {
+	var buf [2]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, errors.Wrap(err, "could not generate a random host id")
+	}
+
+	id := cluster.HostId(binary.BigEndian.Uint16(buf[:]))
+	if id == 0 {
+		// 1-in-65536, but HostId==0 means "unset" elsewhere
+		id = 1
+	}
+	return id, nil
+}
+
+// save writes hs to fn atomically: it writes to a temp file in the same
+// directory, then renames it over fn, so a crash mid-write cannot leave a
+// truncated or corrupted identity file behind.
+func (hs *HostState) save(fn string) error {
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return errors.Wrapf(err, "could not marshal host state for %s", fn)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return errors.Wrapf(err, "could not create directory for host state file %s", fn)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fn), filepath.Base(fn)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "could not create temp file for host state %s", fn)
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return errors.Wrapf(err, "could not write host state to %s", tmpName)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return errors.Wrapf(err, "could not close temp host state file %s", tmpName)
+	}
+
+	if err := os.Rename(tmpName, fn); err != nil {
+		os.Remove(tmpName)
+		return errors.Wrapf(err, "could not rename %s to %s", tmpName, fn)
+	}
+
+	return nil
+}
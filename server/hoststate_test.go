@@ -0,0 +1,126 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateHostStateGeneratesId(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{JournalsDir: dir}
+
+	hs, err := c.LoadOrCreateHostState()
+	if err != nil {
+		t.Fatalf("LoadOrCreateHostState() error = %v", err)
+	}
+	if hs.HostId == 0 {
+		t.Error("HostId = 0, want a generated non-zero id")
+	}
+	if hs.Generation != 1 {
+		t.Errorf("Generation = %d, want 1", hs.Generation)
+	}
+	if c.HostHostId != hs.HostId {
+		t.Errorf("Config.HostHostId = %v, want it wired back to %v", c.HostHostId, hs.HostId)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hostStateFileName)); err != nil {
+		t.Errorf("host state file not written: %v", err)
+	}
+}
+
+func TestLoadOrCreateHostStateReloadIncrementsGeneration(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := (&Config{JournalsDir: dir}).LoadOrCreateHostState()
+	if err != nil {
+		t.Fatalf("first LoadOrCreateHostState() error = %v", err)
+	}
+
+	second, err := (&Config{JournalsDir: dir}).LoadOrCreateHostState()
+	if err != nil {
+		t.Fatalf("second LoadOrCreateHostState() error = %v", err)
+	}
+
+	if second.HostId != first.HostId {
+		t.Errorf("HostId changed across restarts: %v -> %v, want it persisted", first.HostId, second.HostId)
+	}
+	if second.Generation != first.Generation+1 {
+		t.Errorf("Generation = %d, want %d", second.Generation, first.Generation+1)
+	}
+}
+
+func TestLoadOrCreateHostStateMismatchRejected(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := (&Config{JournalsDir: dir}).LoadOrCreateHostState()
+	if err != nil {
+		t.Fatalf("LoadOrCreateHostState() error = %v", err)
+	}
+
+	_, err = (&Config{JournalsDir: dir, HostHostId: first.HostId + 1}).LoadOrCreateHostState()
+	if err == nil {
+		t.Fatal("LoadOrCreateHostState() expected a mismatch error for a different configured HostHostId, got nil")
+	}
+}
+
+func TestHostStateValidate(t *testing.T) {
+	hs := &HostState{HostId: 5}
+
+	if err := hs.Validate(0); err != nil {
+		t.Errorf("Validate(0) = %v, want nil - no configured id means nothing to check", err)
+	}
+	if err := hs.Validate(5); err != nil {
+		t.Errorf("Validate(5) = %v, want nil - matches the on-disk id", err)
+	}
+	if err := hs.Validate(6); err == nil {
+		t.Error("Validate(6) = nil, want an error for a mismatched configured HostHostId")
+	}
+}
+
+func TestHostStateSaveIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, hostStateFileName)
+
+	hs := &HostState{HostId: 7, Generation: 1}
+	if err := hs.save(fn); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() != hostStateFileName {
+			t.Errorf("leftover temp file after save(): %s, want only %s", e.Name(), hostStateFileName)
+		}
+	}
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	loaded := &HostState{}
+	if err := json.Unmarshal(data, loaded); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if loaded.HostId != hs.HostId || loaded.Generation != hs.Generation {
+		t.Errorf("loaded = %+v, want %+v", loaded, hs)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/logrange/range/pkg/cluster"
+)
+
+// fieldSet is a bitmask over Config's fields, recording which ones a given
+// layer (a file, the environment, CLI flags) explicitly provided, as
+// opposed to merely holding a Go zero value. It is what lets ResolveConfig
+// tell "the user didn't set this" apart from "the user set this to the
+// zero value" - e.g. legitimately passing -host-lease-ttl-sec=0 to disable
+// lease renewal.
+//
+// Every bit tracks a leaf field, never a whole nested struct: PublicApiRpc
+// and PrivateApiRpc get one bit per transport.Config sub-field (ListenAddr
+// and all the Tls* fields), so that a layer which only touches one of them
+// can never be mistaken for one that explicitly cleared a sibling
+// sub-field it never mentioned.
+type fieldSet uint64
+
+const (
+	fsJournalsDir fieldSet = 1 << iota
+	fsHostHostId
+	fsHostLeaseTTLSec
+	fsHostRegisterTimeoutSec
+	fsPublicApiRpcListenAddr
+	fsPublicApiRpcTlsEnabled
+	fsPublicApiRpcTls2Way
+	fsPublicApiRpcTlsSkipVerify
+	fsPublicApiRpcTlsCAFile
+	fsPublicApiRpcTlsKeyFile
+	fsPublicApiRpcTlsCertFile
+	fsPrivateApiRpcListenAddr
+	fsPrivateApiRpcTlsEnabled
+	fsPrivateApiRpcTls2Way
+	fsPrivateApiRpcTlsSkipVerify
+	fsPrivateApiRpcTlsCAFile
+	fsPrivateApiRpcTlsKeyFile
+	fsPrivateApiRpcTlsCertFile
+)
+
+// fieldBits maps a dotted, lower-cased Config field path - e.g.
+// "publicapirpc.listenaddr" for the nested ListenAddr - to its fieldSet
+// bit. Top-level scalar fields are keyed by their bare lower-cased name.
+var fieldBits = map[string]fieldSet{
+	"journalsdir":            fsJournalsDir,
+	"hosthostid":             fsHostHostId,
+	"hostleasettlsec":        fsHostLeaseTTLSec,
+	"hostregistertimeoutsec": fsHostRegisterTimeoutSec,
+
+	"publicapirpc.listenaddr":    fsPublicApiRpcListenAddr,
+	"publicapirpc.tlsenabled":    fsPublicApiRpcTlsEnabled,
+	"publicapirpc.tls2way":       fsPublicApiRpcTls2Way,
+	"publicapirpc.tlsskipverify": fsPublicApiRpcTlsSkipVerify,
+	"publicapirpc.tlscafile":     fsPublicApiRpcTlsCAFile,
+	"publicapirpc.tlskeyfile":    fsPublicApiRpcTlsKeyFile,
+	"publicapirpc.tlscertfile":   fsPublicApiRpcTlsCertFile,
+
+	"privateapirpc.listenaddr":    fsPrivateApiRpcListenAddr,
+	"privateapirpc.tlsenabled":    fsPrivateApiRpcTlsEnabled,
+	"privateapirpc.tls2way":       fsPrivateApiRpcTls2Way,
+	"privateapirpc.tlsskipverify": fsPrivateApiRpcTlsSkipVerify,
+	"privateapirpc.tlscafile":     fsPrivateApiRpcTlsCAFile,
+	"privateapirpc.tlskeyfile":    fsPrivateApiRpcTlsKeyFile,
+	"privateapirpc.tlscertfile":   fsPrivateApiRpcTlsCertFile,
+}
+
+// fieldBit returns the fieldSet bit for a dotted field path, matched
+// case-insensitively, or 0 if path isn't a known field.
+func fieldBit(path string) fieldSet {
+	return fieldBits[strings.ToLower(path)]
+}
+
+// ResolveConfig merges defaults, file, env and flags, in that priority
+// order (later arguments win), applying a layer's field only where that
+// layer's fieldSet marks it as explicitly provided. Any argument may be
+// nil, meaning that layer contributes nothing. This replaces the old
+// reflect.DeepEqual(zero value) heuristic in Apply.
+func ResolveConfig(defaults, file, env, flags *Config) *Config {
+	c := &Config{}
+	for _, l := range []*Config{defaults, file, env, flags} {
+		if l == nil {
+			continue
+		}
+		c.applyLayer(l)
+	}
+	return c
+}
+
+// applyLayer overlays onto c every field l.set marks as explicitly set.
+func (c *Config) applyLayer(l *Config) {
+	if l.set&fsJournalsDir != 0 {
+		c.JournalsDir = l.JournalsDir
+	}
+	if l.set&fsHostHostId != 0 {
+		c.HostHostId = l.HostHostId
+	}
+	if l.set&fsHostLeaseTTLSec != 0 {
+		c.HostLeaseTTLSec = l.HostLeaseTTLSec
+	}
+	if l.set&fsHostRegisterTimeoutSec != 0 {
+		c.HostRegisterTimeoutSec = l.HostRegisterTimeoutSec
+	}
+	if l.set&fsPublicApiRpcListenAddr != 0 {
+		c.PublicApiRpc.ListenAddr = l.PublicApiRpc.ListenAddr
+	}
+	if l.set&fsPublicApiRpcTlsEnabled != 0 {
+		c.PublicApiRpc.TlsEnabled = l.PublicApiRpc.TlsEnabled
+	}
+	if l.set&fsPublicApiRpcTls2Way != 0 {
+		c.PublicApiRpc.Tls2Way = l.PublicApiRpc.Tls2Way
+	}
+	if l.set&fsPublicApiRpcTlsSkipVerify != 0 {
+		c.PublicApiRpc.TlsSkipVerify = l.PublicApiRpc.TlsSkipVerify
+	}
+	if l.set&fsPublicApiRpcTlsCAFile != 0 {
+		c.PublicApiRpc.TlsCAFile = l.PublicApiRpc.TlsCAFile
+	}
+	if l.set&fsPublicApiRpcTlsKeyFile != 0 {
+		c.PublicApiRpc.TlsKeyFile = l.PublicApiRpc.TlsKeyFile
+	}
+	if l.set&fsPublicApiRpcTlsCertFile != 0 {
+		c.PublicApiRpc.TlsCertFile = l.PublicApiRpc.TlsCertFile
+	}
+
+	if l.set&fsPrivateApiRpcListenAddr != 0 {
+		c.PrivateApiRpc.ListenAddr = l.PrivateApiRpc.ListenAddr
+	}
+	if l.set&fsPrivateApiRpcTlsEnabled != 0 {
+		c.PrivateApiRpc.TlsEnabled = l.PrivateApiRpc.TlsEnabled
+	}
+	if l.set&fsPrivateApiRpcTls2Way != 0 {
+		c.PrivateApiRpc.Tls2Way = l.PrivateApiRpc.Tls2Way
+	}
+	if l.set&fsPrivateApiRpcTlsSkipVerify != 0 {
+		c.PrivateApiRpc.TlsSkipVerify = l.PrivateApiRpc.TlsSkipVerify
+	}
+	if l.set&fsPrivateApiRpcTlsCAFile != 0 {
+		c.PrivateApiRpc.TlsCAFile = l.PrivateApiRpc.TlsCAFile
+	}
+	if l.set&fsPrivateApiRpcTlsKeyFile != 0 {
+		c.PrivateApiRpc.TlsKeyFile = l.PrivateApiRpc.TlsKeyFile
+	}
+	if l.set&fsPrivateApiRpcTlsCertFile != 0 {
+		c.PrivateApiRpc.TlsCertFile = l.PrivateApiRpc.TlsCertFile
+	}
+	c.set |= l.set
+}
+
+// flagFieldSet maps a flag name registered by RegisterFlags to its
+// fieldSet bit.
+var flagFieldSet = map[string]fieldSet{
+	"journals-dir":              fsJournalsDir,
+	"host-id":                   fsHostHostId,
+	"host-lease-ttl-sec":        fsHostLeaseTTLSec,
+	"host-register-timeout-sec": fsHostRegisterTimeoutSec,
+
+	"public-api-rpc-listen-addr":     fsPublicApiRpcListenAddr,
+	"public-api-rpc-tls-enabled":     fsPublicApiRpcTlsEnabled,
+	"public-api-rpc-tls-2way":        fsPublicApiRpcTls2Way,
+	"public-api-rpc-tls-skip-verify": fsPublicApiRpcTlsSkipVerify,
+	"public-api-rpc-tls-ca-file":     fsPublicApiRpcTlsCAFile,
+	"public-api-rpc-tls-key-file":    fsPublicApiRpcTlsKeyFile,
+	"public-api-rpc-tls-cert-file":   fsPublicApiRpcTlsCertFile,
+
+	"private-api-rpc-listen-addr":     fsPrivateApiRpcListenAddr,
+	"private-api-rpc-tls-enabled":     fsPrivateApiRpcTlsEnabled,
+	"private-api-rpc-tls-2way":        fsPrivateApiRpcTls2Way,
+	"private-api-rpc-tls-skip-verify": fsPrivateApiRpcTlsSkipVerify,
+	"private-api-rpc-tls-ca-file":     fsPrivateApiRpcTlsCAFile,
+	"private-api-rpc-tls-key-file":    fsPrivateApiRpcTlsKeyFile,
+	"private-api-rpc-tls-cert-file":   fsPrivateApiRpcTlsCertFile,
+}
+
+// RegisterFlags binds every Config field to a flag on fs, seeded with the
+// values already in c (typically GetDefaultConfig()). It returns a
+// function that must be called after fs.Parse: it copies the parsed
+// values back into c and marks, in c's fieldSet, exactly the flags the
+// user actually passed on the command line, so the result can be fed as
+// the flags layer to ResolveConfig.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) func() {
+	journalsDir := fs.String("journals-dir", c.JournalsDir,
+		"Path on the local file-system where journals data is stored")
+	hostId := fs.Uint64("host-id", uint64(c.HostHostId),
+		"The host unique identifier, if not set, then it will be assigned automatically")
+	hostLeaseTTLSec := fs.Int("host-lease-ttl-sec", c.HostLeaseTTLSec,
+		"The Lease timeout in seconds, for registering Host in the storage")
+	hostRegisterTimeoutSec := fs.Int("host-register-timeout-sec", c.HostRegisterTimeoutSec,
+		"How long the host will try to register in the storage until it is successfuly registered or stop. 0 value means the timeout will be ignored")
+	publicApiRpcListenAddr := fs.String("public-api-rpc-listen-addr", c.PublicApiRpc.ListenAddr,
+		"Listen address for the public RPC API")
+	publicApiRpcTlsEnabled := fs.Bool("public-api-rpc-tls-enabled", c.PublicApiRpc.TlsEnabled,
+		"Whether TLS is enabled for the public RPC API")
+	publicApiRpcTls2Way := fs.Bool("public-api-rpc-tls-2way", c.PublicApiRpc.Tls2Way,
+		"Whether mutual (2-way) TLS is required for the public RPC API")
+	publicApiRpcTlsSkipVerify := fs.Bool("public-api-rpc-tls-skip-verify", c.PublicApiRpc.TlsSkipVerify,
+		"Whether to skip TLS certificate verification for the public RPC API")
+	publicApiRpcTlsCAFile := fs.String("public-api-rpc-tls-ca-file", c.PublicApiRpc.TlsCAFile,
+		"CA file for the public RPC API TLS")
+	publicApiRpcTlsKeyFile := fs.String("public-api-rpc-tls-key-file", c.PublicApiRpc.TlsKeyFile,
+		"Key file for the public RPC API TLS")
+	publicApiRpcTlsCertFile := fs.String("public-api-rpc-tls-cert-file", c.PublicApiRpc.TlsCertFile,
+		"Certificate file for the public RPC API TLS")
+
+	privateApiRpcListenAddr := fs.String("private-api-rpc-listen-addr", c.PrivateApiRpc.ListenAddr,
+		"Listen address for the private RPC API")
+	privateApiRpcTlsEnabled := fs.Bool("private-api-rpc-tls-enabled", c.PrivateApiRpc.TlsEnabled,
+		"Whether TLS is enabled for the private RPC API")
+	privateApiRpcTls2Way := fs.Bool("private-api-rpc-tls-2way", c.PrivateApiRpc.Tls2Way,
+		"Whether mutual (2-way) TLS is required for the private RPC API")
+	privateApiRpcTlsSkipVerify := fs.Bool("private-api-rpc-tls-skip-verify", c.PrivateApiRpc.TlsSkipVerify,
+		"Whether to skip TLS certificate verification for the private RPC API")
+	privateApiRpcTlsCAFile := fs.String("private-api-rpc-tls-ca-file", c.PrivateApiRpc.TlsCAFile,
+		"CA file for the private RPC API TLS")
+	privateApiRpcTlsKeyFile := fs.String("private-api-rpc-tls-key-file", c.PrivateApiRpc.TlsKeyFile,
+		"Key file for the private RPC API TLS")
+	privateApiRpcTlsCertFile := fs.String("private-api-rpc-tls-cert-file", c.PrivateApiRpc.TlsCertFile,
+		"Certificate file for the private RPC API TLS")
+
+	return func() {
+		c.JournalsDir = *journalsDir
+		c.HostHostId = cluster.HostId(*hostId)
+		c.HostLeaseTTLSec = *hostLeaseTTLSec
+		c.HostRegisterTimeoutSec = *hostRegisterTimeoutSec
+
+		c.PublicApiRpc.ListenAddr = *publicApiRpcListenAddr
+		c.PublicApiRpc.TlsEnabled = *publicApiRpcTlsEnabled
+		c.PublicApiRpc.Tls2Way = *publicApiRpcTls2Way
+		c.PublicApiRpc.TlsSkipVerify = *publicApiRpcTlsSkipVerify
+		c.PublicApiRpc.TlsCAFile = *publicApiRpcTlsCAFile
+		c.PublicApiRpc.TlsKeyFile = *publicApiRpcTlsKeyFile
+		c.PublicApiRpc.TlsCertFile = *publicApiRpcTlsCertFile
+
+		c.PrivateApiRpc.ListenAddr = *privateApiRpcListenAddr
+		c.PrivateApiRpc.TlsEnabled = *privateApiRpcTlsEnabled
+		c.PrivateApiRpc.Tls2Way = *privateApiRpcTls2Way
+		c.PrivateApiRpc.TlsSkipVerify = *privateApiRpcTlsSkipVerify
+		c.PrivateApiRpc.TlsCAFile = *privateApiRpcTlsCAFile
+		c.PrivateApiRpc.TlsKeyFile = *privateApiRpcTlsKeyFile
+		c.PrivateApiRpc.TlsCertFile = *privateApiRpcTlsCertFile
+
+		c.set = 0
+		fs.Visit(func(f *flag.Flag) {
+			c.set |= flagFieldSet[f.Name]
+		})
+	}
+}
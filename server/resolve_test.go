@@ -0,0 +1,116 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/logrange/range/pkg/transport"
+)
+
+func TestResolveConfigLayering(t *testing.T) {
+	defaults := &Config{
+		JournalsDir:     "/opt/logrange/db/",
+		HostLeaseTTLSec: 5,
+		PublicApiRpc:    transport.Config{ListenAddr: "127.0.0.1:9966"},
+		set:             fsJournalsDir | fsHostLeaseTTLSec | fsPublicApiRpcListenAddr,
+	}
+	file := &Config{
+		HostLeaseTTLSec: 10,
+		PublicApiRpc:    transport.Config{ListenAddr: "0.0.0.0:9966"},
+		set:             fsHostLeaseTTLSec | fsPublicApiRpcListenAddr,
+	}
+	env := &Config{
+		// explicitly disables lease renewal, not "unset"
+		HostLeaseTTLSec: 0,
+		set:             fsHostLeaseTTLSec,
+	}
+
+	got := ResolveConfig(defaults, file, env, nil)
+
+	if got.JournalsDir != "/opt/logrange/db/" {
+		t.Errorf("JournalsDir = %q, want the default to survive untouched layers", got.JournalsDir)
+	}
+	if got.HostLeaseTTLSec != 0 {
+		t.Errorf("HostLeaseTTLSec = %d, want 0 from the env layer, not 10 from file", got.HostLeaseTTLSec)
+	}
+	if got.PublicApiRpc.ListenAddr != "0.0.0.0:9966" {
+		t.Errorf("PublicApiRpc.ListenAddr = %q, want file layer's value since env never set it", got.PublicApiRpc.ListenAddr)
+	}
+}
+
+func TestResolveConfigPreservesUntouchedSiblingField(t *testing.T) {
+	file := &Config{
+		PublicApiRpc: transport.Config{ListenAddr: "10.0.0.1:9966"},
+		set:          fsPublicApiRpcListenAddr,
+	}
+	// env only overrides PrivateApiRpc - it must not disturb PublicApiRpc
+	env := &Config{
+		PrivateApiRpc: transport.Config{ListenAddr: "10.0.0.1:9967"},
+		set:           fsPrivateApiRpcListenAddr,
+	}
+
+	got := ResolveConfig(nil, file, env, nil)
+
+	if got.PublicApiRpc.ListenAddr != "10.0.0.1:9966" {
+		t.Errorf("PublicApiRpc.ListenAddr = %q, want file layer's value preserved", got.PublicApiRpc.ListenAddr)
+	}
+	if got.PrivateApiRpc.ListenAddr != "10.0.0.1:9967" {
+		t.Errorf("PrivateApiRpc.ListenAddr = %q, want env layer's value", got.PrivateApiRpc.ListenAddr)
+	}
+}
+
+func TestResolveConfigMergesTlsFields(t *testing.T) {
+	defaults := &Config{
+		PublicApiRpc: transport.Config{ListenAddr: "127.0.0.1:9966"},
+		set:          fsPublicApiRpcListenAddr,
+	}
+	file := &Config{
+		PublicApiRpc: transport.Config{
+			TlsEnabled:  true,
+			TlsCertFile: "/etc/logrange/public.crt",
+			TlsKeyFile:  "/etc/logrange/public.key",
+		},
+		set: fsPublicApiRpcTlsEnabled | fsPublicApiRpcTlsCertFile | fsPublicApiRpcTlsKeyFile,
+	}
+
+	got := ResolveConfig(defaults, file, nil, nil)
+
+	if got.PublicApiRpc.ListenAddr != "127.0.0.1:9966" {
+		t.Errorf("ListenAddr = %q, want the default's value to survive (file never touched it)", got.PublicApiRpc.ListenAddr)
+	}
+	if !got.PublicApiRpc.TlsEnabled {
+		t.Error("TlsEnabled = false, want true from the file layer - TLS settings must not be dropped when only ListenAddr is tracked elsewhere")
+	}
+	if got.PublicApiRpc.TlsCertFile != "/etc/logrange/public.crt" {
+		t.Errorf("TlsCertFile = %q, want /etc/logrange/public.crt", got.PublicApiRpc.TlsCertFile)
+	}
+	if got.PublicApiRpc.TlsKeyFile != "/etc/logrange/public.key" {
+		t.Errorf("TlsKeyFile = %q, want /etc/logrange/public.key", got.PublicApiRpc.TlsKeyFile)
+	}
+}
+
+func TestResolveConfigNilLayers(t *testing.T) {
+	defaults := GetDefaultConfig()
+
+	got := ResolveConfig(defaults, nil, nil, nil)
+
+	if got.JournalsDir != defaults.JournalsDir {
+		t.Errorf("JournalsDir = %q, want %q", got.JournalsDir, defaults.JournalsDir)
+	}
+	if got.PublicApiRpc != defaults.PublicApiRpc {
+		t.Errorf("PublicApiRpc = %+v, want %+v", got.PublicApiRpc, defaults.PublicApiRpc)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jrivets/log4g"
+	"github.com/pkg/errors"
+)
+
+// OnChangeFunc is invoked by a ConfigWatcher after the watched file is
+// re-parsed into a new Config. Implementations inspect old and new to
+// decide whether anything they care about changed, and apply the new
+// values to the subsystem they own. Returning an error fails the whole
+// reload - the ConfigWatcher logs it and keeps serving old unaffected.
+//
+// A listener must also accept being called a second time with old and new
+// swapped, i.e. OnChange(new, old): that is how the ConfigWatcher asks an
+// already-applied listener to roll back to the previous Config when a
+// later listener in the same reload rejects it.
+type OnChangeFunc func(old, new *Config) error
+
+// frozenFields lists the Config fields that cannot be safely hot-swapped
+// because the subsystems built on top of them (e.g. the journal storage)
+// are never reinitialized after startup. A reload that changes one of
+// these is rejected in full, and the previously loaded Config is retained.
+var frozenFields = []string{"JournalsDir"}
+
+// Option customizes a ConfigWatcher returned by NewConfigWatcher.
+type Option func(*cwOptions)
+
+type cwOptions struct {
+	disabled bool
+}
+
+// DisableConfigWatch makes NewConfigWatcher return a ConfigWatcher that
+// never starts an fsnotify watch and whose Close is a no-op. Listeners can
+// still be registered, but they will never be invoked. Intended for tests
+// that build a server without touching the file-system.
+func DisableConfigWatch() Option {
+	return func(o *cwOptions) {
+		o.disabled = true
+	}
+}
+
+// ConfigWatcher watches the file a Config was loaded from and, on every
+// write, re-parses it via LoadConfig and notifies the registered listeners
+// of the diff against the currently held Config. It is modelled after
+// Mattermost's AddConfigListener/RemoveConfigListener: independent
+// subsystems (transport, cluster, host registry) subscribe without knowing
+// about each other.
+type ConfigWatcher struct {
+	lock      sync.Mutex
+	filename  string
+	cur       *Config
+	fsw       *fsnotify.Watcher
+	listeners map[int]OnChangeFunc
+	nextId    int
+	done      chan struct{}
+	logger    log4g.Logger
+}
+
+// NewConfigWatcher creates a ConfigWatcher for filename, which must be the
+// same file cur was loaded from via LoadConfig. The watch goroutine is
+// started immediately unless DisableConfigWatch was passed.
+func NewConfigWatcher(filename string, cur *Config, opts ...Option) (*ConfigWatcher, error) {
+	var o cwOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	cw := &ConfigWatcher{
+		filename:  filename,
+		cur:       cur,
+		listeners: make(map[int]OnChangeFunc),
+		done:      make(chan struct{}),
+		logger:    log4g.GetLogger("ConfigWatcher"),
+	}
+
+	if o.disabled || filename == "" {
+		return cw, nil
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create fsnotify watcher for %s", filename)
+	}
+	if err := fsw.Add(filename); err != nil {
+		fsw.Close()
+		return nil, errors.Wrapf(err, "could not watch %s", filename)
+	}
+	cw.fsw = fsw
+
+	go cw.run()
+	return cw, nil
+}
+
+// AddConfigListener registers fn to be called whenever the watched file is
+// successfully reloaded. It returns a handle to be passed to
+// RemoveConfigListener.
+func (cw *ConfigWatcher) AddConfigListener(fn OnChangeFunc) int {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	id := cw.nextId
+	cw.nextId++
+	cw.listeners[id] = fn
+	return id
+}
+
+// RemoveConfigListener unregisters the listener previously returned by
+// AddConfigListener. Removing an unknown or already-removed id is a no-op.
+func (cw *ConfigWatcher) RemoveConfigListener(id int) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	delete(cw.listeners, id)
+}
+
+// Close stops the watch goroutine. It is safe to call on a disabled
+// ConfigWatcher.
+func (cw *ConfigWatcher) Close() error {
+	if cw.fsw == nil {
+		return nil
+	}
+	close(cw.done)
+	return cw.fsw.Close()
+}
+
+func (cw *ConfigWatcher) run() {
+	for {
+		select {
+		case <-cw.done:
+			return
+		case ev, ok := <-cw.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				// Atomic write-temp-then-rename (see HostState.save) or a
+				// ConfigMap symlink swap both replace the watched inode,
+				// which silently kills an inotify watch on the old one.
+				// Re-arm it on the path, which by now points at the new
+				// file, then fall through to reload.
+				if err := cw.fsw.Add(cw.filename); err != nil {
+					cw.logger.Error("could not re-watch ", cw.filename, " after it was replaced: ", err)
+				}
+				cw.reload()
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			cw.reload()
+		case err, ok := <-cw.fsw.Errors:
+			if !ok {
+				return
+			}
+			cw.logger.Error("fsnotify error watching ", cw.filename, ": ", err)
+		}
+	}
+}
+
+func (cw *ConfigWatcher) reload() {
+	newCfg, err := LoadConfig(cw.filename)
+	if err != nil {
+		cw.logger.Error("could not reload ", cw.filename, ": ", err)
+		return
+	}
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	oldCfg := cw.cur
+
+	if err := validateHotSwap(oldCfg, newCfg); err != nil {
+		cw.logger.Error("rejecting config reload from ", cw.filename, ": ", err)
+		return
+	}
+
+	// Call listeners in a fixed order, not map iteration order, so a
+	// partial failure below rolls back the same listeners every time.
+	ids := make([]int, 0, len(cw.listeners))
+	for id := range cw.listeners {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	applied := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if err := cw.listeners[id](oldCfg, newCfg); err != nil {
+			cw.logger.Error("listener rejected config reload from ", cw.filename, ": ", err)
+			cw.rollback(applied, oldCfg, newCfg)
+			return
+		}
+		applied = append(applied, id)
+	}
+
+	cw.cur = newCfg
+	cw.logger.Info("configuration reloaded from ", cw.filename)
+}
+
+// rollback asks every listener in applied, which already accepted newCfg,
+// to go back to oldCfg, in reverse order. cw.cur is left untouched by the
+// caller, so it still matches oldCfg.
+func (cw *ConfigWatcher) rollback(applied []int, oldCfg, newCfg *Config) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		id := applied[i]
+		if err := cw.listeners[id](newCfg, oldCfg); err != nil {
+			cw.logger.Error("listener ", id, " failed to roll back after a rejected reload of ", cw.filename, ": ", err)
+		}
+	}
+}
+
+// validateHotSwap returns an error naming the first frozen field that
+// differs between old and new, so the caller can keep serving old.
+func validateHotSwap(old, new *Config) error {
+	ov := reflect.ValueOf(old).Elem()
+	nv := reflect.ValueOf(new).Elem()
+	for _, name := range frozenFields {
+		of := ov.FieldByName(name)
+		nf := nv.FieldByName(name)
+		if !reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			return errors.Errorf("field %s cannot be changed without a restart (old=%v, new=%v)", name, of.Interface(), nf.Interface())
+		}
+	}
+	return nil
+}
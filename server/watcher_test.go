@@ -0,0 +1,118 @@
+// Copyright 2018 The logrange Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigWatcherRejectsFrozenFieldChange(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.json")
+
+	oldCfg := &Config{JournalsDir: dir}
+	if err := ioutil.WriteFile(fn, []byte(`{"JournalsDir":"`+dir+`/changed"}`), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cw, err := NewConfigWatcher(fn, oldCfg, DisableConfigWatch())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+
+	called := false
+	cw.AddConfigListener(func(old, new *Config) error {
+		called = true
+		return nil
+	})
+
+	cw.reload()
+
+	if cw.cur != oldCfg {
+		t.Error("cw.cur changed after a JournalsDir change, which must be rejected without a restart")
+	}
+	if called {
+		t.Error("listener was invoked despite the frozen-field validation rejecting the reload")
+	}
+}
+
+func TestConfigWatcherRollsBackAppliedListenersOnRejection(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.json")
+
+	oldCfg := &Config{JournalsDir: dir, HostLeaseTTLSec: 5}
+	if err := ioutil.WriteFile(fn, []byte(`{"JournalsDir":"`+dir+`","HostLeaseTTLSec":10}`), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cw, err := NewConfigWatcher(fn, oldCfg, DisableConfigWatch())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+
+	var lastSeenByListener1 *Config
+	cw.AddConfigListener(func(old, new *Config) error {
+		lastSeenByListener1 = new
+		return nil
+	})
+	cw.AddConfigListener(func(old, new *Config) error {
+		return errors.New("listener2 always rejects")
+	})
+
+	cw.reload()
+
+	if cw.cur != oldCfg {
+		t.Error("cw.cur changed despite listener2 rejecting the reload")
+	}
+	if lastSeenByListener1 != oldCfg {
+		t.Errorf("listener1 was not rolled back to oldCfg after listener2 rejected the reload, last saw %+v", lastSeenByListener1)
+	}
+}
+
+func TestConfigWatcherAppliesAcceptedReload(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.json")
+
+	oldCfg := &Config{JournalsDir: dir, HostLeaseTTLSec: 5}
+	if err := ioutil.WriteFile(fn, []byte(`{"JournalsDir":"`+dir+`","HostLeaseTTLSec":10}`), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	cw, err := NewConfigWatcher(fn, oldCfg, DisableConfigWatch())
+	if err != nil {
+		t.Fatalf("NewConfigWatcher() error = %v", err)
+	}
+
+	var applied *Config
+	cw.AddConfigListener(func(old, new *Config) error {
+		applied = new
+		return nil
+	})
+
+	cw.reload()
+
+	if cw.cur == oldCfg {
+		t.Error("cw.cur did not advance to the new config after every listener accepted it")
+	}
+	if cw.cur.HostLeaseTTLSec != 10 {
+		t.Errorf("cw.cur.HostLeaseTTLSec = %d, want 10", cw.cur.HostLeaseTTLSec)
+	}
+	if applied != cw.cur {
+		t.Error("listener was not called with the config that became cw.cur")
+	}
+}